@@ -0,0 +1,475 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"math"
+	"sort"
+)
+
+// Helpers related to quantile calculation for conventional histograms.
+
+// Bucket represents a bucket of a classic histogram. It is used internally by
+// BucketQuantile, but is also useful for other code that needs to reason
+// about histogram buckets, e.g. the OpenTelemetry bridge.
+type Bucket struct {
+	UpperBound float64
+	Count      float64
+}
+
+// Buckets implements sort.Interface.
+type Buckets []Bucket
+
+func (b Buckets) Len() int           { return len(b) }
+func (b Buckets) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b Buckets) Less(i, j int) bool { return b[i].UpperBound < b[j].UpperBound }
+
+// eps is the relative tolerance used to distinguish a real bucket-count
+// change (caused e.g. by a counter reset) from one that is merely the
+// result of imprecise floating-point summation further up the query
+// pipeline. Any count within this fraction of the running max, in either
+// direction, is treated as noise and normalized to the running max rather
+// than treated as a new high-water mark; that avoids letting a
+// noise-inflated max leak into, and distort, later interpolation.
+const eps = 1e-9
+
+// BucketQuantile calculates the quantile 'q' based on the given buckets. The
+// buckets will be sorted by upperBound by this function (they might already
+// be sorted). BucketQuantile is part of the rate_calculation, so the counters
+// in the buckets are assumed to be 0 based (only works correctly if the
+// buckets are in fact deltas of an increasing counter over time, such as the
+// result of a `rate()` call over a classic histogram).
+//
+// If 'buckets' has 0 observations, NaN is returned.
+//
+// If the highest bucket is not +Inf, NaN is returned.
+//
+// If q<0, -Inf is returned.
+//
+// If q>1, +Inf is returned.
+//
+// Whether the buckets are forced to be monotonic is tracked by the first
+// returned bool. A non-monotonic bucket count can happen either because of
+// floating point inaccuracies introduced during sample ingestion or because
+// of actual corruption in the data. If the deviation is within a small
+// tolerance, it is corrected and the second returned bool is true to
+// indicate that a fix was applied. If the deviation is too large to be
+// attributed to floating point inaccuracies, the first returned bool is
+// true to indicate that the monotonicity was forced.
+func BucketQuantile(q float64, buckets Buckets) (value float64, forced, fixed bool) {
+	return BucketQuantileWithOptions(q, buckets, QuantileOptions{})
+}
+
+// InterpolationMode selects how BucketQuantileWithOptions interpolates the
+// observed rank inside the bucket that was picked to hold the quantile.
+type InterpolationMode int
+
+const (
+	// InterpLinear interpolates linearly between the bucket's lower and
+	// upper bound. This is the classic, historical behavior of
+	// BucketQuantile and matches the assumption that observations are
+	// uniformly distributed within a bucket.
+	InterpLinear InterpolationMode = iota
+	// InterpLogLinear interpolates on a logarithmic scale between the
+	// bucket's lower and upper bound. This matches histograms whose
+	// bucket boundaries follow a geometric progression (the common case
+	// for latency histograms). Inside a bucket with a positive lower
+	// bound its estimate is never above InterpLinear's; the two agree at
+	// the bucket's bounds.
+	InterpLogLinear
+)
+
+// NOTE: InterpLogLinear is only wired up at the Go API level
+// (BucketQuantileWithOptions). Exposing it at the PromQL surface -- e.g. a
+// histogram_quantile_log function, or a third argument to
+// histogram_quantile -- requires changes to the parser and query engine
+// (promql/parser, promql/engine, promql/functions.go), none of which are
+// part of this package; that wiring is left for a follow-up change against
+// those files.
+
+// MonotonicityMode selects how BucketQuantileWithOptions repairs a bucket
+// sequence whose counts do not increase monotonically with UpperBound.
+type MonotonicityMode int
+
+const (
+	// Clamp is the historical behavior: walk the buckets left to right
+	// and clamp any count that falls more than eps below the running
+	// max back up to that max. This is cheap, but it lets a single
+	// noise-inflated bucket permanently raise the "floor" for every
+	// bucket after it, distorting the fit when a real (non-noise) drop
+	// occurs, e.g. because of a counter reset in one of several
+	// federated series.
+	Clamp MonotonicityMode = iota
+	// Isotonic runs Pool-Adjacent-Violators regression over the bucket
+	// counts, producing the L2-optimal monotone-nondecreasing fit
+	// instead of naively clamping to the running max.
+	Isotonic
+	// Strict treats any bucket-count drop larger than the caller-supplied
+	// AbsTolerance/RelTolerance as an error: BucketQuantileWithOptions
+	// returns NaN and forced=true instead of silently repairing it.
+	Strict
+)
+
+// QuantileOptions controls the behavior of BucketQuantileWithOptions.
+type QuantileOptions struct {
+	// Interpolation selects the interpolation mode used inside the
+	// bucket holding the quantile. The zero value is InterpLinear, so
+	// QuantileOptions{} behaves exactly like the historical BucketQuantile.
+	Interpolation InterpolationMode
+
+	// Monotonicity selects how non-monotonic bucket counts are repaired.
+	// The zero value is Clamp, so QuantileOptions{} behaves exactly like
+	// the historical BucketQuantile.
+	Monotonicity MonotonicityMode
+
+	// AbsTolerance and RelTolerance bound the bucket-count drop that
+	// Strict mode will tolerate before treating it as a real violation:
+	// a drop is tolerated if it is at most AbsTolerance + RelTolerance *
+	// (running max). They are ignored outside of Strict mode.
+	AbsTolerance float64
+	RelTolerance float64
+}
+
+// BucketQuantileWithOptions behaves like BucketQuantile but additionally
+// takes a QuantileOptions, which can select an interpolation mode other than
+// the default linear one. See InterpolationMode for the supported modes.
+func BucketQuantileWithOptions(q float64, buckets Buckets, opts QuantileOptions) (value float64, forced, fixed bool) {
+	if math.IsNaN(q) {
+		return math.NaN(), false, false
+	}
+	if q < 0 {
+		return math.Inf(-1), false, false
+	}
+	if q > 1 {
+		return math.Inf(+1), false, false
+	}
+	if len(buckets) < 2 {
+		return math.NaN(), false, false
+	}
+	sort.Sort(buckets)
+	if !math.IsInf(buckets[len(buckets)-1].UpperBound, +1) {
+		return math.NaN(), false, false
+	}
+
+	buckets = coalesceBuckets(buckets)
+	forced, fixed = ensureMonotonicWithOptions(buckets, opts)
+	if opts.Monotonicity == Strict && forced {
+		return math.NaN(), forced, fixed
+	}
+
+	if len(buckets) < 2 {
+		return math.NaN(), forced, fixed
+	}
+	observations := buckets[len(buckets)-1].Count
+	if observations == 0 {
+		return math.NaN(), forced, fixed
+	}
+	rank := q * observations
+	b := sort.Search(len(buckets)-1, func(i int) bool { return buckets[i].Count >= rank })
+
+	if b == len(buckets)-1 {
+		return buckets[len(buckets)-2].UpperBound, forced, fixed
+	}
+	if b == 0 && buckets[0].UpperBound <= 0 {
+		return buckets[0].UpperBound, forced, fixed
+	}
+	var (
+		bucketStart = 0.0
+		bucketEnd   = buckets[b].UpperBound
+		count       = buckets[b].Count
+	)
+	if b > 0 {
+		bucketStart = buckets[b-1].UpperBound
+		count -= buckets[b-1].Count
+		rank -= buckets[b-1].Count
+	}
+	frac := rank / count
+
+	if opts.Interpolation == InterpLogLinear && bucketStart > 0 && !math.IsInf(bucketEnd, +1) {
+		return bucketStart * math.Pow(bucketEnd/bucketStart, frac), forced, fixed
+	}
+	return bucketStart + (bucketEnd-bucketStart)*frac, forced, fixed
+}
+
+// Helpers related to quantile calculation for native histograms.
+
+// NativeBucket represents a single bucket of a native (sparse, exponential)
+// histogram. Unlike Bucket, whose Count is cumulative up to UpperBound,
+// NativeBucket.Count is the number of observations falling within that one
+// bucket only. The bucket's real bounds are not stored explicitly; they are
+// derived from Index and the histogram's schema, see nativeBucketBounds.
+type NativeBucket struct {
+	Index int32
+	Count float64
+}
+
+// nativeBucketBounds returns the lower and upper bound of the bucket at the
+// given index for a native histogram with the given schema, following
+// base = 2^(2^-schema), lower = base^Index, upper = base^(Index+1).
+func nativeBucketBounds(schema, index int32) (lower, upper float64) {
+	base := math.Pow(2, math.Pow(2, -float64(schema)))
+	return math.Pow(base, float64(index)), math.Pow(base, float64(index+1))
+}
+
+// NativeBucketQuantile calculates the quantile 'q' based on the given
+// native (sparse, exponential) histogram buckets. positive and negative
+// hold the non-zero buckets on either side of zero; zeroCount is the number
+// of observations in the symmetric zero bucket [-zeroThreshold,
+// +zeroThreshold]. Like the buckets passed to BucketQuantile, positive and
+// negative do not need to be pre-sorted; their indices also need not be
+// contiguous.
+//
+// The same NaN/Inf edge cases and the same forced/fixed monotonicity
+// reporting as BucketQuantile apply; see its doc comment.
+func NativeBucketQuantile(q float64, schema int32, zeroCount, zeroThreshold float64, positive, negative []NativeBucket) (value float64, forced, fixed bool) {
+	return NativeBucketQuantileWithOptions(q, schema, zeroCount, zeroThreshold, positive, negative, QuantileOptions{})
+}
+
+// nativeSpan is a bucket with its bounds resolved to real values, kept in
+// ascending order of value (from the most negative bucket, through the
+// zero bucket, to the largest positive bucket).
+type nativeSpan struct {
+	lower, upper float64
+	count        float64
+}
+
+// NativeBucketQuantileWithOptions behaves like NativeBucketQuantile but
+// additionally takes a QuantileOptions, reusing the same monotonicity-repair
+// modes introduced for classic buckets by BucketQuantileWithOptions.
+// opts.Interpolation is ignored: native buckets are exponentially spaced by
+// construction on both sides of zero, so the (exact) log-linear formula is
+// always used for any bucket that doesn't straddle zero -- positive or
+// negative -- regardless of opts.
+func NativeBucketQuantileWithOptions(q float64, schema int32, zeroCount, zeroThreshold float64, positive, negative []NativeBucket, opts QuantileOptions) (value float64, forced, fixed bool) {
+	if math.IsNaN(q) {
+		return math.NaN(), false, false
+	}
+	if q < 0 {
+		return math.Inf(-1), false, false
+	}
+	if q > 1 {
+		return math.Inf(+1), false, false
+	}
+
+	// Negative buckets run from the highest index (largest magnitude,
+	// i.e. most negative value) down to the lowest index (closest to
+	// zero), so sorting by decreasing index walks them in ascending
+	// value order.
+	neg := append([]NativeBucket(nil), negative...)
+	sort.Slice(neg, func(i, j int) bool { return neg[i].Index > neg[j].Index })
+	pos := append([]NativeBucket(nil), positive...)
+	sort.Slice(pos, func(i, j int) bool { return pos[i].Index < pos[j].Index })
+
+	spans := make([]nativeSpan, 0, len(neg)+1+len(pos))
+	for _, b := range neg {
+		lo, hi := nativeBucketBounds(schema, b.Index)
+		spans = append(spans, nativeSpan{lower: -hi, upper: -lo, count: b.Count})
+	}
+	spans = append(spans, nativeSpan{lower: -zeroThreshold, upper: zeroThreshold, count: zeroCount})
+	for _, b := range pos {
+		lo, hi := nativeBucketBounds(schema, b.Index)
+		spans = append(spans, nativeSpan{lower: lo, upper: hi, count: b.Count})
+	}
+
+	buckets := make(Buckets, len(spans))
+	cumulative := 0.0
+	for i, s := range spans {
+		cumulative += s.count
+		buckets[i] = Bucket{UpperBound: s.upper, Count: cumulative}
+	}
+
+	forced, fixed = ensureMonotonicWithOptions(buckets, opts)
+	if opts.Monotonicity == Strict && forced {
+		return math.NaN(), forced, fixed
+	}
+
+	observations := buckets[len(buckets)-1].Count
+	if observations == 0 {
+		return math.NaN(), forced, fixed
+	}
+	rank := q * observations
+	b := sort.Search(len(buckets), func(i int) bool { return buckets[i].Count >= rank })
+	if b >= len(buckets) {
+		b = len(buckets) - 1
+	}
+
+	bucketLower, bucketUpper := spans[b].lower, spans[b].upper
+	count := buckets[b].Count
+	if b > 0 {
+		count -= buckets[b-1].Count
+		rank -= buckets[b-1].Count
+	}
+	if count == 0 {
+		return bucketUpper, forced, fixed
+	}
+	frac := rank / count
+
+	// Unlike classic buckets, native buckets are exponentially spaced by
+	// construction on both sides of zero, so log-linear interpolation --
+	// exact for that layout -- is always used here rather than gated
+	// behind opts.Interpolation. bucketUpper/bucketLower is positive for
+	// any bucket that doesn't straddle zero, whichever sign its bounds
+	// have, so the formula applies equally to negative buckets; only the
+	// symmetric zero bucket (bucketLower < 0 < bucketUpper) falls back
+	// to linear.
+	if bucketLower > 0 || bucketUpper < 0 {
+		return bucketLower * math.Pow(bucketUpper/bucketLower, frac), forced, fixed
+	}
+	return bucketLower + (bucketUpper-bucketLower)*frac, forced, fixed
+}
+
+// coalesceBuckets merges buckets with the same upper bound.
+//
+// The input buckets must be sorted.
+func coalesceBuckets(buckets Buckets) Buckets {
+	last := buckets[0]
+	i := 0
+	for _, b := range buckets[1:] {
+		if b.UpperBound == last.UpperBound {
+			last.Count += b.Count
+		} else {
+			buckets[i] = last
+			last = b
+			i++
+		}
+	}
+	buckets[i] = last
+	return buckets[:i+1]
+}
+
+// The assumption that bucket counts increase monotonically with increasing
+// UpperBound may be violated during:
+//
+//   - Recording rule evaluation of histogram_quantile, especially when rate()
+//     has been applied to the underlying bucket timeseries.
+//   - Evaluation of histogram_quantile computed over federated bucket
+//     timeseries, especially when rate() has been applied.
+//
+// This is because scraped data is not made available to rule evaluation or
+// federation atomically, so some buckets are computed with data from the
+// most recent scrapes, but the other buckets are missing data from the most
+// recent scrape.
+//
+// Monotonicity is usually guaranteed because if a bucket with upper bound u1
+// has count c1, then any bucket with a higher upper bound u > u1 must have
+// counted all c1 observations and possibly more, so that c >= c1.
+//
+// Randomly interspersed partial sampling breaks that guarantee, and rounding
+// errors in floating point arithmetic can break it in addition.
+//
+// ensureMonotonicWithOptions repairs buckets in place according to
+// opts.Monotonicity. It reports whether a real (forced) violation was found
+// and whether any count was changed (fixed). Clamp and Isotonic share the
+// same classification: forced and fixed are determined by the Clamp rule,
+// independent of which of the two modes ends up correcting the bucket
+// counts. Strict additionally counts a drop within the caller-supplied
+// tolerance as fixed rather than forced.
+func ensureMonotonicWithOptions(buckets Buckets, opts QuantileOptions) (forced, fixed bool) {
+	switch opts.Monotonicity {
+	case Strict:
+		return ensureMonotonicClampWithTolerance(buckets, opts.AbsTolerance, opts.RelTolerance)
+	case Isotonic:
+		probe := make(Buckets, len(buckets))
+		copy(probe, buckets)
+		forced, fixed = ensureMonotonicClamp(probe)
+		isotonicRegression(buckets)
+		return forced, fixed
+	default:
+		return ensureMonotonicClamp(buckets)
+	}
+}
+
+// ensureMonotonicClamp is used to correct non-monotonic artifacts by
+// clamping any decreasing counts to the running maximum. A small relative
+// tolerance (eps) is used to distinguish real, meaningful decreases (which
+// get "forced" and flagged) from floating-point noise (which get silently
+// "fixed").
+func ensureMonotonicClamp(buckets Buckets) (forced, fixed bool) {
+	max := buckets[0].Count
+	for i := 1; i < len(buckets); i++ {
+		switch {
+		case buckets[i].Count > max*(1+eps):
+			max = buckets[i].Count
+		case buckets[i].Count >= max*(1-eps):
+			if buckets[i].Count != max {
+				fixed = true
+			}
+			buckets[i].Count = max
+		default:
+			forced = true
+			buckets[i].Count = max
+		}
+	}
+	return
+}
+
+// ensureMonotonicClampWithTolerance implements Strict mode: it behaves like
+// ensureMonotonicClamp for drops within the caller-supplied tolerance, but
+// stops and reports forced=true as soon as it finds a drop that exceeds it,
+// leaving the remaining buckets untouched — the caller is expected to treat
+// a forced result as an error rather than use the (partially repaired)
+// bucket counts.
+func ensureMonotonicClampWithTolerance(buckets Buckets, absTolerance, relTolerance float64) (forced, fixed bool) {
+	max := buckets[0].Count
+	for i := 1; i < len(buckets); i++ {
+		switch {
+		case buckets[i].Count > max*(1+eps):
+			max = buckets[i].Count
+		case buckets[i].Count >= max*(1-eps):
+			if buckets[i].Count != max {
+				fixed = true
+			}
+			buckets[i].Count = max
+		case max-buckets[i].Count <= absTolerance+relTolerance*max:
+			fixed = true
+			buckets[i].Count = max
+		default:
+			forced = true
+			return forced, fixed
+		}
+	}
+	return forced, fixed
+}
+
+// isotonicRegression overwrites buckets' counts in place with the
+// L2-optimal monotone-nondecreasing fit, computed via the
+// Pool-Adjacent-Violators Algorithm (PAVA). It runs in O(n): each bucket is
+// pushed onto a stack of (sum, weight) blocks, merging with the block below
+// it whenever doing so is needed to keep the stack's block means
+// nondecreasing, and the final per-bucket counts are each block's mean
+// repeated across the buckets it covers.
+func isotonicRegression(buckets Buckets) {
+	type block struct {
+		sum, weight float64
+	}
+	stack := make([]block, 0, len(buckets))
+	for _, b := range buckets {
+		cur := block{sum: b.Count, weight: 1}
+		for len(stack) > 0 && cur.sum/cur.weight < stack[len(stack)-1].sum/stack[len(stack)-1].weight {
+			below := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			cur.sum += below.sum
+			cur.weight += below.weight
+		}
+		stack = append(stack, cur)
+	}
+	i := 0
+	for _, blk := range stack {
+		mean := blk.sum / blk.weight
+		for n := int(blk.weight); n > 0; n-- {
+			buckets[i].Count = mean
+			i++
+		}
+	}
+}
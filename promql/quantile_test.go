@@ -316,3 +316,303 @@ func TestBucketQuantile_ForcedMonotonicity(t *testing.T) {
 		})
 	}
 }
+
+func TestBucketQuantileWithOptions_Interpolation(t *testing.T) {
+	eps := 1e-12
+
+	// "real example 2" has exponentially-spaced bucket boundaries
+	// (0.005, 0.01, 0.025, 0.05, 0.1, ...), which is exactly the case
+	// where log-linear interpolation and linear interpolation diverge.
+	realExample2 := func() Buckets {
+		return Buckets{
+			{UpperBound: 0.005, Count: 9.6},
+			{UpperBound: 0.01, Count: 9.688888889},
+			{UpperBound: 0.025, Count: 9.755555556},
+			{UpperBound: 0.05, Count: 9.844444444},
+			{UpperBound: 0.1, Count: 9.888888889},
+			{UpperBound: 0.25, Count: 9.888888889},
+			{UpperBound: 0.5, Count: 9.888888889},
+			{UpperBound: 1, Count: 9.888888889},
+			{UpperBound: 2.5, Count: 9.888888889},
+			{UpperBound: 5, Count: 9.888888889},
+			{UpperBound: 10, Count: 9.888888889},
+			{UpperBound: 25, Count: 9.888888889},
+			{UpperBound: 50, Count: 9.888888889},
+			{UpperBound: 100, Count: 9.888888889},
+			{UpperBound: math.Inf(1), Count: 9.888888889},
+		}
+	}
+
+	for name, tc := range map[string]struct {
+		opts           QuantileOptions
+		expectedValues map[float64]float64
+	}{
+		"linear matches BucketQuantile": {
+			opts: QuantileOptions{Interpolation: InterpLinear},
+			expectedValues: map[float64]float64{
+				1:    0.1,
+				0.99: 0.03468750000281261,
+				0.9:  0.00463541666671875,
+				0.5:  0.0025752314815104174,
+			},
+		},
+		"log-linear diverges from linear inside a bucket with lo>0": {
+			opts: QuantileOptions{Interpolation: InterpLogLinear},
+			expectedValues: map[float64]float64{
+				// q=1 lands at the very top (frac=1) of the (0.05, 0.1]
+				// bucket, where both modes return its upper bound.
+				1: 0.1,
+				// q=0.99 falls inside a bucket with lo>0 and hi<+Inf, so
+				// log-linear interpolation kicks in and yields a lower
+				// (and more realistic) estimate than linear.
+				0.99: 0.03270311578840853,
+				// q=0.9 and q=0.5 fall in the first bucket, whose lower
+				// bound is 0, so log-linear falls back to linear there.
+				0.9: 0.00463541666671875,
+				0.5: 0.0025752314815104174,
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			for q, v := range tc.expectedValues {
+				res, forced, fixed := BucketQuantileWithOptions(q, realExample2(), tc.opts)
+				require.False(t, forced)
+				require.False(t, fixed)
+				require.InEpsilon(t, v, res, eps)
+			}
+		})
+	}
+}
+
+// TestBucketQuantileWithOptions_Monotonicity covers the new Isotonic and
+// Strict MonotonicityModes. It is kept separate from
+// TestBucketQuantile_ForcedMonotonicity, which stays scoped to the original
+// BucketQuantile entry point (implicitly Clamp mode) and its existing
+// fixtures, rather than growing a QuantileOptions/mode dimension into every
+// one of its table-driven cases.
+func TestBucketQuantileWithOptions_Monotonicity(t *testing.T) {
+	eps := 1e-12
+
+	// A genuine (non-noise) dip at the 30 bucket: Clamp just raises that
+	// one bucket back up to the running max of 20, while
+	// Isotonic pools it with its neighbor into an L2-optimal average of
+	// 17.5, which then changes the quantiles computed inside and above
+	// that pooled region.
+	dip := func() Buckets {
+		return Buckets{
+			{UpperBound: 10, Count: 10},
+			{UpperBound: 20, Count: 20},
+			{UpperBound: 30, Count: 15},
+			{UpperBound: 40, Count: 25},
+			{UpperBound: math.Inf(1), Count: 30},
+		}
+	}
+
+	t.Run("clamp and isotonic diverge on a real dip", func(t *testing.T) {
+		for q, v := range map[float64]float64{
+			0.99: 40,
+			0.9:  40,
+			0.7:  32,
+			0.5:  15,
+		} {
+			res, forced, fixed := BucketQuantileWithOptions(q, dip(), QuantileOptions{Monotonicity: Clamp})
+			require.True(t, forced)
+			require.False(t, fixed)
+			require.InEpsilon(t, v, res, eps)
+		}
+		for q, v := range map[float64]float64{
+			0.99: 40,
+			0.9:  40,
+			0.7:  34.666666666666664,
+			0.5:  16.666666666666664,
+		} {
+			res, forced, fixed := BucketQuantileWithOptions(q, dip(), QuantileOptions{Monotonicity: Isotonic})
+			require.True(t, forced)
+			require.False(t, fixed)
+			require.InEpsilon(t, v, res, eps)
+		}
+	})
+
+	t.Run("strict rejects the same dip", func(t *testing.T) {
+		res, forced, fixed := BucketQuantileWithOptions(0.5, dip(), QuantileOptions{Monotonicity: Strict})
+		require.True(t, forced)
+		require.False(t, fixed)
+		require.True(t, math.IsNaN(res))
+	})
+
+	t.Run("strict tolerates float64 noise regardless of tolerance", func(t *testing.T) {
+		// Same float64-imprecision case as "simple - non-monotonic
+		// middle" above: a tiny drop within the shared eps band that
+		// Clamp and Strict both tolerate and fix, even with
+		// RelTolerance left at zero. This exercises the same code path
+		// as Clamp's eps band, not the caller-supplied tolerance below.
+		buckets := func() Buckets {
+			return Buckets{
+				{UpperBound: 10, Count: 10},
+				{UpperBound: 15, Count: 15},
+				{UpperBound: 20, Count: 15.00000000001},
+				{UpperBound: 30, Count: 15},
+				{UpperBound: math.Inf(1), Count: 15},
+			}
+		}
+		opts := QuantileOptions{Monotonicity: Strict}
+		for q, v := range map[float64]float64{
+			1:    15.,
+			0.99: 14.85,
+			0.9:  13.5,
+			0.5:  7.5,
+		} {
+			res, forced, fixed := BucketQuantileWithOptions(q, buckets(), opts)
+			require.False(t, forced)
+			require.True(t, fixed)
+			require.InEpsilon(t, v, res, eps)
+		}
+	})
+
+	// A drop well beyond the float64-noise eps band (0.3%, versus
+	// counts in the tens to hundreds), to actually exercise
+	// ensureMonotonicClampWithTolerance's caller-supplied tolerance
+	// branch rather than the shared eps band above.
+	smallDip := func() Buckets {
+		return Buckets{
+			{UpperBound: 10, Count: 50},
+			{UpperBound: 20, Count: 100},
+			{UpperBound: 30, Count: 99.7},
+			{UpperBound: 40, Count: 150},
+			{UpperBound: math.Inf(1), Count: 200},
+		}
+	}
+
+	t.Run("strict tolerates a drop within the caller's tolerance", func(t *testing.T) {
+		opts := QuantileOptions{Monotonicity: Strict, RelTolerance: 0.01}
+		for q, v := range map[float64]float64{
+			0.99: 40,
+			0.9:  40,
+			0.7:  38,
+			0.5:  20,
+		} {
+			res, forced, fixed := BucketQuantileWithOptions(q, smallDip(), opts)
+			require.False(t, forced)
+			require.True(t, fixed)
+			require.InEpsilon(t, v, res, eps)
+		}
+	})
+
+	t.Run("strict rejects a drop that exceeds the caller's tolerance", func(t *testing.T) {
+		opts := QuantileOptions{Monotonicity: Strict, RelTolerance: 0.0001}
+		res, forced, fixed := BucketQuantileWithOptions(0.5, smallDip(), opts)
+		require.True(t, forced)
+		require.False(t, fixed)
+		require.True(t, math.IsNaN(res))
+	})
+}
+
+func TestNativeBucketQuantile(t *testing.T) {
+	eps := 1e-12
+
+	// schema 0 gives base = 2, so bucket index i covers (2^i, 2^(i+1)]
+	// on the positive side and the mirror image on the negative side.
+	// Passed out of order to exercise the sort/derive-bounds path.
+	positive := []NativeBucket{
+		{Index: 1, Count: 5},
+		{Index: 0, Count: 3},
+	}
+	negative := []NativeBucket{
+		{Index: 0, Count: 1},
+		{Index: 1, Count: 2},
+	}
+	const (
+		schema        = int32(0)
+		zeroCount     = 2.
+		zeroThreshold = 1.
+	)
+	// Total observations: 2 (zero) + 3 + 5 (positive) + 1 + 2 (negative) = 13.
+
+	for name, tc := range map[string]struct {
+		q        float64
+		expected float64
+	}{
+		"mixed positive/negative/zero, falls in a positive bucket": {
+			q:        0.5,
+			expected: 1.4142135623730951, // sqrt(2), exact under log-linear interpolation.
+		},
+		"rank lands exactly on the zero-bucket's upper boundary": {
+			q:        5. / 13.,
+			expected: zeroThreshold,
+		},
+		"falls in a negative bucket": {
+			q:        0.1,
+			expected: -2.549121254638524, // log-linear, exact for this exponential bucket too.
+		},
+		"q=1 resolves to the largest bucket's upper bound": {
+			q:        1,
+			expected: 4,
+		},
+		"falls in the top positive bucket": {
+			q:        0.9,
+			expected: 3.340351677713478,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			res, forced, fixed := NativeBucketQuantile(tc.q, schema, zeroCount, zeroThreshold, positive, negative)
+			require.False(t, forced)
+			require.False(t, fixed)
+			require.InEpsilon(t, tc.expected, res, eps)
+		})
+	}
+}
+
+func TestNativeBucketQuantileWithOptions_Monotonicity(t *testing.T) {
+	eps := 1e-12
+
+	// A genuine (non-noise) dip spanning the zero bucket into the
+	// positive side: the index-1 bucket's count is negative, as can
+	// happen after rate() is applied across a counter reset, so the
+	// cumulative count across zero -> index0 -> index1 -> index2 goes
+	// 10 -> 30 -> 25 -> 50. This is large enough to be rejected outright
+	// by Strict and to make Clamp and Isotonic diverge, mirroring
+	// TestBucketQuantileWithOptions_Monotonicity's "dip" fixture for
+	// classic buckets.
+	dip := func() []NativeBucket {
+		return []NativeBucket{
+			{Index: 0, Count: 20},
+			{Index: 1, Count: -5},
+			{Index: 2, Count: 25},
+		}
+	}
+	const (
+		schema        = int32(0)
+		zeroCount     = 10.
+		zeroThreshold = 1.
+	)
+
+	t.Run("clamp and isotonic diverge on a real dip", func(t *testing.T) {
+		for q, v := range map[float64]float64{
+			0.99: 7.8625647883620084,
+			0.7:  4.756828460010884,
+			0.5:  1.681792830507429,
+		} {
+			res, forced, fixed := NativeBucketQuantileWithOptions(q, schema, zeroCount, zeroThreshold, dip(), nil, QuantileOptions{Monotonicity: Clamp})
+			require.True(t, forced)
+			require.False(t, fixed)
+			require.InEpsilon(t, v, res, eps)
+		}
+		for q, v := range map[float64]float64{
+			0.99: 7.87771802347545,
+			0.7:  5.039684199579492,
+			0.5:  1.8114473285278132,
+		} {
+			res, forced, fixed := NativeBucketQuantileWithOptions(q, schema, zeroCount, zeroThreshold, dip(), nil, QuantileOptions{Monotonicity: Isotonic})
+			require.True(t, forced)
+			require.False(t, fixed)
+			require.InEpsilon(t, v, res, eps)
+		}
+	})
+
+	t.Run("strict rejects the same dip", func(t *testing.T) {
+		res, forced, fixed := NativeBucketQuantileWithOptions(0.5, schema, zeroCount, zeroThreshold, dip(), nil, QuantileOptions{Monotonicity: Strict})
+		require.True(t, forced)
+		require.False(t, fixed)
+		require.True(t, math.IsNaN(res))
+	})
+}